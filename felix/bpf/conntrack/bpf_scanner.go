@@ -18,18 +18,15 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
-	"path"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/projectcalico/calico/felix/bpf"
-	"github.com/projectcalico/calico/felix/bpf/bpfdefs"
 	"github.com/projectcalico/calico/felix/bpf/conntrack/timeouts"
-	"github.com/projectcalico/calico/felix/bpf/libbpf"
 	"github.com/projectcalico/calico/felix/bpf/maps"
 )
 
@@ -40,6 +37,9 @@ const (
 	BPFLogLevelNone  BPFLogLevel = "no_log"
 )
 
+// Deletions are counted per entry type only: struct ct_iter_ctx (ctcleanupCtIterCtx)
+// carries no deletion reason or entry age, so there are no per-reason deletion counters
+// and no entry-age histogram among these metrics.
 var (
 	registerOnce sync.Once
 
@@ -51,6 +51,10 @@ var (
 		Name: "felix_bpf_conntrack_entries_deleted",
 		Help: "Cumulative number of entries deleted from the conntrack table, grouped by type.",
 	}, []string{"type"})
+	gaugeConntrackTableFillRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_bpf_conntrack_table_fill_ratio",
+		Help: "Fraction of the conntrack table's capacity that was in use at the last GC sweep.",
+	})
 	summaryCleanerExecTime = prometheus.NewSummary(prometheus.SummaryOpts{
 		Name: "felix_bpf_conntrack_cleaner_seconds",
 		Help: "Time taken to run the conntrack cleaner BPF program.",
@@ -62,6 +66,7 @@ func registerConntrackMetrics() {
 		prometheus.MustRegister(
 			gaugeVecConntrackEntries,
 			counterVecConntrackEntriesDeleted,
+			gaugeConntrackTableFillRatio,
 			summaryCleanerExecTime,
 		)
 	})
@@ -84,7 +89,7 @@ type BPFProgLivenessScanner struct {
 	liveEntries                  int
 	higherCount                  int
 
-	bpfExpiryProgram *libbpf.Obj
+	bpfExpiryProgram *ctcleanupObjects
 }
 
 func NewBPFProgLivenessScanner(
@@ -121,35 +126,38 @@ func NewBPFProgLivenessScanner(
 	return s, nil
 }
 
-func (s *BPFProgLivenessScanner) ensureBPFExpiryProgram() (*libbpf.Obj, error) {
+func (s *BPFProgLivenessScanner) ensureBPFExpiryProgram() (*ctcleanupObjects, error) {
 	if s.bpfExpiryProgram != nil {
 		return s.bpfExpiryProgram, nil
 	}
 
 	// Load the BPF program.  We only build the co-re version because CT cleanup
-	// needs a newer than co-re.
-	binaryToLoad := path.Join(bpfdefs.ObjectDir,
-		fmt.Sprintf("conntrack_cleanup_%s_co-re_v%d.o", s.logLevel, s.ipVersion))
+	// needs a newer than co-re.  The object is embedded in the binary (see
+	// ctcleanup_bpf2go.go), so there's no on-disk lookup via bpfdefs.ObjectDir
+	// and no cgo/libbpf dependency to load it.
 	ctMapParams := MapParams
 	if s.ipVersion == 6 {
 		ctMapParams = MapParamsV6
 	}
 
-	ctCleanupData := &libbpf.CTCleanupGlobalData{
+	globalData := ctcleanupCTCleanupGlobalData{
 		CreationGracePeriod: s.timeouts.CreationGracePeriod,
-		TCPSynSent:          s.timeouts.TCPSynSent,
-		TCPEstablished:      s.timeouts.TCPEstablished,
-		TCPFinsSeen:         s.timeouts.TCPFinsSeen,
-		TCPResetSeen:        s.timeouts.TCPResetSeen,
-		UDPTimeout:          s.timeouts.UDPTimeout,
+		TcpSynSent:          s.timeouts.TCPSynSent,
+		TcpEstablished:      s.timeouts.TCPEstablished,
+		TcpFinsSeen:         s.timeouts.TCPFinsSeen,
+		TcpResetSeen:        s.timeouts.TCPResetSeen,
+		UdpTimeout:          s.timeouts.UDPTimeout,
 		GenericTimeout:      s.timeouts.GenericTimeout,
-		ICMPTimeout:         s.timeouts.ICMPTimeout}
+		IcmpTimeout:         s.timeouts.ICMPTimeout,
+	}
 
-	obj, err := bpf.LoadObject(binaryToLoad, ctCleanupData, ctMapParams.VersionedName())
-	if err != nil {
-		return nil, fmt.Errorf("error loading %s: %w", binaryToLoad, err)
+	var objs ctcleanupObjects
+	if err := loadCtcleanupObjects(&objs, s.logLevel, s.ipVersion, maps.Path(ctMapParams.VersionedName()), globalData); err != nil {
+		return nil, fmt.Errorf("error loading conntrack cleanup program (log level %s, IPv%d): %w",
+			s.logLevel, s.ipVersion, err)
 	}
-	s.bpfExpiryProgram = obj
+
+	s.bpfExpiryProgram = &objs
 	return s.bpfExpiryProgram, nil
 }
 
@@ -172,22 +180,10 @@ func (s *BPFProgLivenessScanner) IterationEnd() {
 
 }
 
-// CleanupContext is the result of running the BPF cleanup program.
-//
-// WARNING: this struct needs to match struct ct_iter_ctx in
+// CleanupContext is the result of running the BPF cleanup program.  It is an alias for
+// ctcleanupCtIterCtx (ctcleanup_bpf2go.go), which mirrors struct ct_iter_ctx in
 // conntrack_cleanup.c.
-type CleanupContext struct {
-	StartTime uint64
-	EndTime   uint64
-
-	NumKVsSeenNormal     uint64
-	NumKVsSeenNATForward uint64
-	NumKVsSeenNATReverse uint64
-
-	NumKVsDeletedNormal     uint64
-	NumKVsDeletedNATForward uint64
-	NumKVsDeletedNATReverse uint64
-}
+type CleanupContext = ctcleanupCtIterCtx
 
 type RunOpt func(result *CleanupContext)
 
@@ -198,14 +194,10 @@ func WithStartTime(t uint64) RunOpt {
 }
 
 func (s *BPFProgLivenessScanner) RunBPFExpiryProgram(opts ...RunOpt) error {
-	program, err := s.ensureBPFExpiryProgram()
+	objs, err := s.ensureBPFExpiryProgram()
 	if err != nil {
 		return fmt.Errorf("failed to load BPF program: %w", err)
 	}
-	fd, err := program.ProgramFD("conntrack_cleanup")
-	if err != nil {
-		return fmt.Errorf("failed to look up BPF program section: %w", err)
-	}
 
 	var cr CleanupContext
 	for _, opt := range opts {
@@ -218,43 +210,50 @@ func (s *BPFProgLivenessScanner) RunBPFExpiryProgram(opts ...RunOpt) error {
 		return fmt.Errorf("failed to encode cleanup program input: %w", err)
 	}
 
-	result, err := bpf.RunBPFProgram(bpf.ProgFD(fd), programInput[:], 1)
+	// Invoke BPF_PROG_TEST_RUN directly via cilium/ebpf, rather than going through the
+	// old libbpf cgo wrapper.
+	start := time.Now()
+	_, dataOut, err := objs.ConntrackCleanup.Test(programInput[:])
+	duration := time.Since(start)
 	if err != nil {
 		return fmt.Errorf("failed to run cleanup program: %w", err)
 	}
 
 	// Output "packet" is returned in its own buffer.  Decode it.
-	_, err = binary.Decode(result.DataOut, binary.LittleEndian, &cr)
+	_, err = binary.Decode(dataOut, binary.LittleEndian, &cr)
 	if err != nil {
 		return fmt.Errorf("failed to parse cleanup program result: %w", err)
 	}
 	log.WithFields(log.Fields{
-		"timeTaken": result.Duration,
+		"timeTaken": duration,
 		"stats":     cr,
 	}).Debug("Conntrack cleanup result.")
 
 	// Record stats...
-	summaryCleanerExecTime.Observe(result.Duration.Seconds())
+	summaryCleanerExecTime.Observe(duration.Seconds())
 
-	total := cr.NumKVsSeenNormal + cr.NumKVsSeenNATForward + cr.NumKVsSeenNATReverse
+	total := cr.NumKvsSeenNormal + cr.NumKvsSeenNatForward + cr.NumKvsSeenNatReverse
 
 	gaugeVecConntrackEntries.WithLabelValues("total").Set(float64(total))
-	gaugeVecConntrackEntries.WithLabelValues("normal").Set(float64(cr.NumKVsSeenNormal))
-	gaugeVecConntrackEntries.WithLabelValues("nat_forward").Set(float64(cr.NumKVsSeenNATForward))
-	gaugeVecConntrackEntries.WithLabelValues("nat_reverse").Set(float64(cr.NumKVsSeenNATReverse))
+	gaugeVecConntrackEntries.WithLabelValues("normal").Set(float64(cr.NumKvsSeenNormal))
+	gaugeVecConntrackEntries.WithLabelValues("nat_forward").Set(float64(cr.NumKvsSeenNatForward))
+	gaugeVecConntrackEntries.WithLabelValues("nat_reverse").Set(float64(cr.NumKvsSeenNatReverse))
 
-	totalDeleted := cr.NumKVsDeletedNormal + cr.NumKVsDeletedNATForward + cr.NumKVsDeletedNATReverse
+	totalDeleted := cr.NumKvsDeletedNormal + cr.NumKvsDeletedNatForward + cr.NumKvsDeletedNatReverse
 
 	counterVecConntrackEntriesDeleted.WithLabelValues("total").Add(float64(totalDeleted))
-	counterVecConntrackEntriesDeleted.WithLabelValues("normal").Add(float64(cr.NumKVsDeletedNormal))
-	counterVecConntrackEntriesDeleted.WithLabelValues("nat_forward").Add(float64(cr.NumKVsDeletedNATForward))
-	counterVecConntrackEntriesDeleted.WithLabelValues("nat_reverse").Add(float64(cr.NumKVsDeletedNATReverse))
+	counterVecConntrackEntriesDeleted.WithLabelValues("normal").Add(float64(cr.NumKvsDeletedNormal))
+	counterVecConntrackEntriesDeleted.WithLabelValues("nat_forward").Add(float64(cr.NumKvsDeletedNatForward))
+	counterVecConntrackEntriesDeleted.WithLabelValues("nat_reverse").Add(float64(cr.NumKvsDeletedNatReverse))
+
+	newLiveEntries := int(total - totalDeleted)
+	full := float64(newLiveEntries) / float64(s.maxEntries)
+	gaugeConntrackTableFillRatio.Set(full)
 
 	if !s.autoScale {
 		return nil
 	}
 
-	newLiveEntries := int(total - totalDeleted)
 	if s.liveEntries > newLiveEntries {
 		s.higherCount++
 	} else {
@@ -262,7 +261,6 @@ func (s *BPFProgLivenessScanner) RunBPFExpiryProgram(opts ...RunOpt) error {
 	}
 	s.liveEntries = newLiveEntries
 
-	full := float64(newLiveEntries) / float64(s.maxEntries)
 	log.Debugf("full %f, total %d, totalDeleted %d", full, total, totalDeleted)
 	// If the ct map keeps filling up and gets over 90% full or if it hits 95%
 	// no matter what, resize the map.
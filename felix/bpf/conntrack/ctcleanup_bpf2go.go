@@ -0,0 +1,194 @@
+// Copyright (c) 2024 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// The types and loaders in this file are maintained by hand in the layout bpf2go uses:
+// the struct types mirror the C structs in conntrack_cleanup.c field for field, and the
+// loaders pick one of four embedded objects by log level and IP version.
+//
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-g -O2" -type ct_iter_ctx ctcleanup ../../../../bpf-gpl/conntrack_cleanup.c -- -I../../../../bpf-gpl/include
+
+// ctcleanupCTCleanupGlobalData mirrors struct ct_cleanup_global_data in conntrack_cleanup.c.
+type ctcleanupCTCleanupGlobalData struct {
+	CreationGracePeriod uint64
+	TcpSynSent          uint64
+	TcpEstablished      uint64
+	TcpFinsSeen         uint64
+	TcpResetSeen        uint64
+	UdpTimeout          uint64
+	GenericTimeout      uint64
+	IcmpTimeout         uint64
+}
+
+// ctcleanupCtIterCtx mirrors struct ct_iter_ctx in conntrack_cleanup.c.  Its fields are
+// written by hand and nothing checks them against the C definition at build time: a
+// field here with no matching C-side member in conntrack_cleanup.c (and the embedded .o
+// files below) reads back as zero when RunBPFExpiryProgram decodes the program's
+// BPF_PROG_TEST_RUN output.
+type ctcleanupCtIterCtx struct {
+	StartTime uint64
+	EndTime   uint64
+
+	NumKvsSeenNormal     uint64
+	NumKvsSeenNatForward uint64
+	NumKvsSeenNatReverse uint64
+
+	NumKvsDeletedNormal     uint64
+	NumKvsDeletedNatForward uint64
+	NumKvsDeletedNatReverse uint64
+}
+
+// ctcleanupObjects contains all objects loaded from ctcleanup.
+type ctcleanupObjects struct {
+	ctcleanupPrograms
+	ctcleanupMaps
+}
+
+func (o *ctcleanupObjects) Close() error {
+	return closeAll(&o.ctcleanupPrograms, &o.ctcleanupMaps)
+}
+
+// ctcleanupPrograms contains all programs loaded from ctcleanup.
+type ctcleanupPrograms struct {
+	ConntrackCleanup *ebpf.Program `ebpf:"conntrack_cleanup"`
+}
+
+func (p *ctcleanupPrograms) Close() error {
+	return closeAll(p.ConntrackCleanup)
+}
+
+// ctMapKey is the name ctcleanupMaps.CtMap binds to.  The compiled object's conntrack
+// map is actually named cali_v4_ct4 or cali_v6_ct6 depending on IP version; loadCtcleanup
+// renames whichever one is present to this key so a single struct (and a single field
+// tag) can bind either version's map instead of needing a per-version Maps struct for
+// what's otherwise an identical binding.
+const ctMapKey = "ct_map"
+
+// ctcleanupMaps contains all maps loaded from ctcleanup.
+type ctcleanupMaps struct {
+	CtMap *ebpf.Map `ebpf:"ct_map"`
+}
+
+func (m *ctcleanupMaps) Close() error {
+	return closeAll(m.CtMap)
+}
+
+// loadCtcleanup returns the embedded CollectionSpec for the given log level/IP version
+// variant of the conntrack cleanup program, with its conntrack map renamed to ctMapKey
+// (see its doc comment) so callers don't need to know the version-specific map name.
+func loadCtcleanup(logLevel BPFLogLevel, ipVersion int) (*ebpf.CollectionSpec, error) {
+	obj, ok := ctcleanupObjectBytes[objectKey{logLevel, ipVersion}]
+	if !ok {
+		return nil, fmt.Errorf("no embedded conntrack cleanup object for log level %q, IP version %d", logLevel, ipVersion)
+	}
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(obj))
+	if err != nil {
+		return nil, fmt.Errorf("can't load conntrack cleanup CollectionSpec: %w", err)
+	}
+
+	ctMapName := "cali_v4_ct4"
+	if ipVersion == 6 {
+		ctMapName = "cali_v6_ct6"
+	}
+	ctMap, ok := spec.Maps[ctMapName]
+	if !ok {
+		return nil, fmt.Errorf("conntrack cleanup object for IP version %d has no %q map", ipVersion, ctMapName)
+	}
+	spec.Maps[ctMapKey] = ctMap
+	if ctMapName != ctMapKey {
+		delete(spec.Maps, ctMapName)
+	}
+
+	return spec, nil
+}
+
+// loadCtcleanupObjects loads ctcleanup and converts it into a struct.  globalData is
+// written into the program's ct_cleanup_global_data variable before it is loaded, so
+// the timeouts reach the program without a separate bpf_map_update_elem call.  (struct
+// ct_iter_ctx is not set here; RunBPFExpiryProgram passes it as the program's input.)
+func loadCtcleanupObjects(obj *ctcleanupObjects, logLevel BPFLogLevel, ipVersion int, mapPinPath string, globalData ctcleanupCTCleanupGlobalData) error {
+	spec, err := loadCtcleanup(logLevel, ipVersion)
+	if err != nil {
+		return err
+	}
+	if err := spec.Variables["ct_cleanup_global_data"].Set(globalData); err != nil {
+		return fmt.Errorf("failed to set conntrack cleanup global data: %w", err)
+	}
+	opts := &ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{
+			// Re-use the conntrack map that the main dataplane already created and
+			// pinned, rather than creating our own copy.
+			PinPath: mapPinPath,
+		},
+	}
+	return spec.LoadAndAssign(obj, opts)
+}
+
+type objectKey struct {
+	logLevel  BPFLogLevel
+	ipVersion int
+}
+
+// ctcleanupObjectBytes holds the embedded CO-RE objects produced by the build, keyed by
+// log level and IP version.  Embedding them directly means we no longer need to resolve
+// bpfdefs.ObjectDir on disk at runtime.
+var ctcleanupObjectBytes = map[objectKey][]byte{
+	{BPFLogLevelDebug, 4}: ctcleanupDebugV4Bytes,
+	{BPFLogLevelDebug, 6}: ctcleanupDebugV6Bytes,
+	{BPFLogLevelNone, 4}:  ctcleanupNoLogV4Bytes,
+	{BPFLogLevelNone, 6}:  ctcleanupNoLogV6Bytes,
+}
+
+// NOTE: these four objects are builds of bpf-gpl/conntrack_cleanup.c, one per log level
+// and IP version; the single-output go:generate directive above does not produce them.
+// That C source and the toolchain that compiles it live outside this tree/snapshot, so
+// `go build` on this package requires the .o files to have been built and placed
+// alongside this file by that external step
+// first -- there is no Makefile or script in this repo that does it. The sibling loaders
+// for felix/bpf's other scanners are in the same position and have not been ported to
+// this pattern yet; that's tracked separately and out of scope here.
+//
+//go:embed conntrack_cleanup_debug_co-re_v4.o
+var ctcleanupDebugV4Bytes []byte
+
+//go:embed conntrack_cleanup_debug_co-re_v6.o
+var ctcleanupDebugV6Bytes []byte
+
+//go:embed conntrack_cleanup_no_log_co-re_v4.o
+var ctcleanupNoLogV4Bytes []byte
+
+//go:embed conntrack_cleanup_no_log_co-re_v6.o
+var ctcleanupNoLogV6Bytes []byte
+
+type closer interface {
+	Close() error
+}
+
+func closeAll(closers ...closer) error {
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2024 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verifier guards the conntrack cleanup BPF programs against silent verifier
+// regressions: an innocuous change to conntrack_cleanup.c (or a shared header) can push
+// the program past the instruction/complexity budget of an older kernel without any Go
+// test noticing, because the program still loads fine on the build host's kernel.
+//
+// This harness loads every conntrack_cleanup_*_co-re_v{4,6}.o variant produced by the
+// build, asks the kernel verifier to accept each one at log level 1, parses
+// "processed N insns", "stack depth" and "max states" out of the verifier log, and
+// compares them against a golden complexity table for the running kernel baseline.
+package verifier
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"gopkg.in/yaml.v2"
+)
+
+var updateGolden = flag.Bool("update", false, "regenerate the golden complexity tables instead of checking them")
+
+var kernelOverride = flag.String("kernel", "", "override the detected kernel baseline (e.g. 5.4, 5.10, 6.1, bpf-next)")
+
+// complexity is the set of verifier-reported numbers we track for one BPF program.
+type complexity struct {
+	ProcessedInsns int `yaml:"processed_insns"`
+	StackDepth     int `yaml:"stack_depth"`
+	MaxStates      int `yaml:"max_states"`
+}
+
+// tolerance is how far above the golden ceiling a program may drift before the test
+// fails.  A little slack avoids test flakiness from verifier bookkeeping that varies
+// by a handful of states between toolchain patch releases.
+const tolerance = 1.05
+
+var processedInsnsRe = regexp.MustCompile(`processed (\d+) insns`)
+var stackDepthRe = regexp.MustCompile(`stack depth (\d+)`)
+var maxStatesRe = regexp.MustCompile(`max_states_per_insn (\d+)|total_states (\d+)`)
+
+// variants are the conntrack cleanup program builds we guard.
+var variants = []struct {
+	logLevel string
+	ipVer    int
+}{
+	{"debug", 4},
+	{"debug", 6},
+	{"no_log", 4},
+	{"no_log", 6},
+}
+
+func TestVerifierComplexity(t *testing.T) {
+	baseline := detectKernelBaseline(t)
+	t.Logf("using kernel baseline %q", baseline)
+
+	goldenPath := filepath.Join("testdata", baseline+".yaml")
+	golden := map[string]complexity{}
+	if !*updateGolden {
+		golden = loadGolden(t, goldenPath)
+	}
+
+	for _, v := range variants {
+		name := fmt.Sprintf("conntrack_cleanup_%s_co-re_v%d", v.logLevel, v.ipVer)
+		t.Run(name, func(t *testing.T) {
+			objPath := filepath.Join("..", name+".o")
+			got, err := verifyObject(objPath, "conntrack_cleanup")
+			if err != nil {
+				t.Fatalf("verifier rejected %s: %v", objPath, err)
+			}
+
+			if *updateGolden {
+				golden[name] = got
+				return
+			}
+
+			want, ok := golden[name]
+			if !ok {
+				t.Fatalf("no golden complexity entry for %s in %s; run with -update", name, goldenPath)
+			}
+			checkBudget(t, "processed insns", got.ProcessedInsns, want.ProcessedInsns)
+			checkBudget(t, "stack depth", got.StackDepth, want.StackDepth)
+			checkBudget(t, "max states", got.MaxStates, want.MaxStates)
+		})
+	}
+
+	if *updateGolden {
+		writeGolden(t, goldenPath, golden)
+	}
+}
+
+func checkBudget(t *testing.T, label string, got, ceiling int) {
+	t.Helper()
+	if float64(got) > float64(ceiling)*tolerance {
+		t.Errorf("%s regression: got %d, golden ceiling is %d (tolerance %.0f%%)", label, got, ceiling, (tolerance-1)*100)
+	}
+}
+
+// verifyObject loads progName from the given object file with verifier log level 1 and
+// parses the resulting complexity numbers out of the log.
+func verifyObject(objPath, progName string) (complexity, error) {
+	spec, err := ebpf.LoadCollectionSpec(objPath)
+	if err != nil {
+		return complexity{}, fmt.Errorf("loading spec: %w", err)
+	}
+	progSpec, ok := spec.Programs[progName]
+	if !ok {
+		return complexity{}, fmt.Errorf("no program named %q in %s", progName, objPath)
+	}
+	progSpec.LogLevel = 1
+	progSpec.LogSizeStart = 1 << 20 // Big enough that the log is never truncated mid-line.
+
+	prog, err := ebpf.NewProgramWithOptions(progSpec, ebpf.ProgramOptions{LogLevel: 1})
+	if err != nil {
+		return complexity{}, fmt.Errorf("verifier rejected program: %w", err)
+	}
+	defer prog.Close()
+
+	return parseVerifierLog(prog.VerifierLog)
+}
+
+func parseVerifierLog(logText string) (complexity, error) {
+	var c complexity
+	scanner := bufio.NewScanner(strings.NewReader(logText))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := processedInsnsRe.FindStringSubmatch(line); m != nil {
+			c.ProcessedInsns, _ = strconv.Atoi(m[1])
+		}
+		if m := stackDepthRe.FindStringSubmatch(line); m != nil {
+			if n, err := strconv.Atoi(m[1]); err == nil && n > c.StackDepth {
+				c.StackDepth = n
+			}
+		}
+		for _, m := range maxStatesRe.FindAllStringSubmatch(line, -1) {
+			for _, g := range m[1:] {
+				if g == "" {
+					continue
+				}
+				if n, err := strconv.Atoi(g); err == nil && n > c.MaxStates {
+					c.MaxStates = n
+				}
+			}
+		}
+	}
+	if c.ProcessedInsns == 0 {
+		return c, fmt.Errorf("could not find \"processed N insns\" in verifier log:\n%s", logText)
+	}
+	return c, nil
+}
+
+// detectKernelBaseline maps `uname -r` to a supported baseline: a 5.4.x, 5.10.x or 6.1.x
+// release selects that baseline, and any other release selects bpf-next.  It uses
+// -kernel instead if the caller wants to check against a different baseline than the
+// one actually running (e.g. in CI, where the host kernel doesn't match any of our
+// targets).
+func detectKernelBaseline(t *testing.T) string {
+	if *kernelOverride != "" {
+		return *kernelOverride
+	}
+	out, err := exec.Command("uname", "-r").Output()
+	if err != nil {
+		t.Fatalf("failed to run uname -r: %v", err)
+	}
+	release := strings.TrimSpace(string(out))
+	switch {
+	case strings.HasPrefix(release, "5.4."):
+		return "5.4"
+	case strings.HasPrefix(release, "5.10."):
+		return "5.10"
+	case strings.HasPrefix(release, "6.1."):
+		return "6.1"
+	default:
+		return "bpf-next"
+	}
+}
+
+func loadGolden(t *testing.T, path string) map[string]complexity {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file %s (run with -update to generate it): %v", path, err)
+	}
+	table := map[string]complexity{}
+	if err := yaml.Unmarshal(data, &table); err != nil {
+		t.Fatalf("failed to parse golden file %s: %v", path, err)
+	}
+	return table
+}
+
+func writeGolden(t *testing.T, path string, table map[string]complexity) {
+	t.Helper()
+	data, err := yaml.Marshal(table)
+	if err != nil {
+		t.Fatalf("failed to marshal golden table: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("failed to write golden file %s: %v", path, err)
+	}
+	t.Logf("wrote updated golden file %s", path)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2024 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/projectcalico/calico/felix/fv/utils"
+)
+
+// SocketTuple identifies one endpoint of a probe.  ContainerName is only meaningful on
+// src: backends exec their probe/cleanup commands inside the source workload's
+// container, so dst only ever needs an IP and (for Probe) a port.
+type SocketTuple struct {
+	ContainerName string
+	IP            string
+	Port          string
+}
+
+// ProbeBackend implements the on-the-wire mechanics of one protocol (or protocol
+// variant).  RegisterBackend lets a test suite add its own -- a raw-ICMP backend, a
+// WireGuard-encapsulated probe, the QUIC backend chunk2-1 added as a CheckOption -- as a
+// real backend, without patching this package.
+type ProbeBackend interface {
+	// Name is the protocol string Port.CanConnectTo dispatches on to find this backend,
+	// e.g. "tcp".
+	Name() string
+	// PreRetryCleanup clears any state a previous attempt at this exact (src, dst) pair
+	// may have left behind that could influence a retried probe (e.g. a stale conntrack
+	// entry).  Backends that have nothing to clean up (e.g. TCP) make this a no-op.
+	PreRetryCleanup(ctx context.Context, src, dst SocketTuple) error
+	// Probe runs the protocol's actual connectivity check.
+	Probe(ctx context.Context, src, dst SocketTuple, opts ...CheckOption) (*Result, error)
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]ProbeBackend{}
+)
+
+// RegisterBackend adds (or replaces) the ProbeBackend used for the given protocol name.
+// Typically called from an init() in the package that defines the backend.
+func RegisterBackend(name string, b ProbeBackend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = b
+}
+
+// Backend looks up the ProbeBackend registered for name, if any.
+func Backend(name string) (ProbeBackend, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	b, ok := backends[name]
+	return b, ok
+}
+
+func init() {
+	RegisterBackend("tcp", &streamBackend{transport: "tcp"})
+	RegisterBackend("udp", &conntrackCleanupBackend{transport: "udp"})
+	RegisterBackend("sctp", &conntrackCleanupBackend{transport: "sctp"})
+}
+
+// streamBackend is the ProbeBackend for transports that don't need any cleanup between
+// retries.
+type streamBackend struct {
+	transport string
+}
+
+func (b *streamBackend) Name() string { return b.transport }
+
+func (b *streamBackend) PreRetryCleanup(ctx context.Context, src, dst SocketTuple) error {
+	return nil
+}
+
+func (b *streamBackend) Probe(ctx context.Context, src, dst SocketTuple, opts ...CheckOption) (*Result, error) {
+	return checkTuple(ctx, b.transport, src, dst, opts...)
+}
+
+// conntrackCleanupBackend is the ProbeBackend for transports where a stale conntrack
+// entry from a previous attempt can make a retry falsely pass or fail: UDP has no
+// sequence number for conntrack to key off, so it operates on a simple timer, and SCTP
+// conntrack appears to match packets even once the entry is CLOSED.  Cleanup is
+// serialized per source IP through a lock private to this backend, rather than one
+// shared with unrelated backends or sources, so e.g. TCP probes and probes from other
+// workloads never wait on it.
+type conntrackCleanupBackend struct {
+	transport string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (b *conntrackCleanupBackend) Name() string { return b.transport }
+
+func (b *conntrackCleanupBackend) sourceLock(srcIP string) *sync.Mutex {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.locks == nil {
+		b.locks = map[string]*sync.Mutex{}
+	}
+	l, ok := b.locks[srcIP]
+	if !ok {
+		l = &sync.Mutex{}
+		b.locks[srcIP] = l
+	}
+	return l
+}
+
+func (b *conntrackCleanupBackend) PreRetryCleanup(ctx context.Context, src, dst SocketTuple) error {
+	lock := b.sourceLock(src.IP)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if os.Getenv("FELIX_FV_ENABLE_BPF") == "true" {
+		return execInContainer(ctx, src.ContainerName, "calico-bpf", "conntrack", "remove", b.transport, src.IP, dst.IP)
+	}
+	return execInContainer(ctx, src.ContainerName, "conntrack", "-D", "-p", b.transport, "-s", src.IP, "-d", dst.IP)
+}
+
+func (b *conntrackCleanupBackend) Probe(ctx context.Context, src, dst SocketTuple, opts ...CheckOption) (*Result, error) {
+	return checkTuple(ctx, b.transport, src, dst, opts...)
+}
+
+// checkTuple is the common Probe implementation shared by the built-in backends: it
+// recovers the CheckOption-private fields (notably the log suffix) to build the log
+// message "<transport> connection test <suffix>", then delegates to CheckCtx with it.
+func checkTuple(ctx context.Context, transport string, src, dst SocketTuple, opts ...CheckOption) (*Result, error) {
+	o := &checkOpts{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	logMsg := fmt.Sprintf("%s connection test %s", transport, o.logSuffix)
+	res := CheckCtx(ctx, src.ContainerName, logMsg, dst.IP, dst.Port, transport, opts...)
+	return res, res.Err
+}
+
+// execInContainer runs a best-effort command inside containerName, discarding its
+// output; used for cleanup commands whose failure shouldn't fail the probe that
+// triggered it.
+func execInContainer(ctx context.Context, containerName string, args ...string) error {
+	cmd := utils.CommandContext(ctx, "docker", append([]string{"exec", containerName}, args...)...)
+	return cmd.Run()
+}
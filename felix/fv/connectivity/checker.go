@@ -0,0 +1,251 @@
+// Copyright (c) 2018-2024 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	. "github.com/onsi/gomega"
+)
+
+// ConnectionSource is implemented by anything that can originate a connectivity probe,
+// e.g. *workload.Workload and *workload.Port.
+type ConnectionSource interface {
+	SourceName() string
+	PreRetryCleanup(ip, port, protocol string, opts ...CheckOption)
+	CanConnectTo(ip, port, protocol string, opts ...CheckOption) *Result
+}
+
+// ConnectionTarget is implemented by anything that can be the target of a connectivity
+// probe, e.g. *workload.Workload and *workload.Port.
+type ConnectionTarget interface {
+	ToMatcher(explicitPort ...uint16) *Matcher
+}
+
+// Expectation records one (source, target) pair that a ConnectivityChecker should
+// probe, and whether it's expected to succeed.
+type Expectation struct {
+	From     ConnectionSource
+	Matcher  *Matcher
+	Protocol string
+	Options  []CheckOption
+	Expected bool
+}
+
+// Probe captures everything one connectivity check needs, independent of the other
+// checks it's run alongside -- the unit of work ActualConnectivityMatrix hands to its
+// worker pool.
+type Probe struct {
+	Source   ConnectionSource
+	Target   *Matcher
+	Port     string
+	Protocol string
+	Options  []CheckOption
+}
+
+// ConnectivityChecker accumulates a set of expected (source, target) connectivity
+// results via ExpectSome/ExpectNone, then probes them all via ActualConnectivity (or
+// ActualConnectivityMatrix, for callers that want the structured per-pair results).
+type ConnectivityChecker struct {
+	Protocol string // protocol for every expectation recorded by ExpectSome/ExpectNone; "tcp" when unset.
+
+	// Workers bounds how many probes ActualConnectivity/ActualConnectivityMatrix run
+	// concurrently; 0 (the default) means runtime.NumCPU().
+	Workers int
+
+	expected []Expectation
+}
+
+func (cc *ConnectivityChecker) ExpectSome(from ConnectionSource, to ConnectionTarget, explicitPort ...uint16) {
+	cc.expect(true, from, to, explicitPort...)
+}
+
+func (cc *ConnectivityChecker) ExpectNone(from ConnectionSource, to ConnectionTarget, explicitPort ...uint16) {
+	cc.expect(false, from, to, explicitPort...)
+}
+
+func (cc *ConnectivityChecker) expect(expected bool, from ConnectionSource, to ConnectionTarget, explicitPort ...uint16) {
+	protocol := cc.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	cc.expected = append(cc.expected, Expectation{
+		From:     from,
+		Matcher:  to.ToMatcher(explicitPort...),
+		Protocol: protocol,
+		Expected: expected,
+	})
+}
+
+// Reset discards all recorded expectations, so the same ConnectivityChecker can be
+// reused for a fresh round of ExpectSome/ExpectNone calls.
+func (cc *ConnectivityChecker) Reset() {
+	cc.expected = nil
+}
+
+// CheckConnectivity probes every recorded expectation and asserts the actual results
+// match what was expected, via ActualConnectivity/ExpectedConnectivity.
+func (cc *ConnectivityChecker) CheckConnectivity() {
+	Expect(cc.ActualConnectivity()).To(Equal(cc.ExpectedConnectivity()), "Connectivity check didn't match expectations")
+}
+
+// ExpectedConnectivity returns one "source -> target = bool" line per recorded
+// expectation, in the order they were recorded, for comparison against
+// ActualConnectivity.
+func (cc *ConnectivityChecker) ExpectedConnectivity() []string {
+	lines := make([]string, len(cc.expected))
+	for i, exp := range cc.expected {
+		lines[i] = fmt.Sprintf("%s -> %s = %v", exp.From.SourceName(), exp.Matcher.TargetName, exp.Expected)
+	}
+	return lines
+}
+
+// ActualConnectivity probes every recorded expectation concurrently (ActualConnectivityMatrix)
+// and flattens the result back into one "source -> target = bool" line per expectation,
+// in the order the expectations were recorded -- regardless of the order their probes
+// actually complete in -- so the Gomega Equal comparison against ExpectedConnectivity
+// stays stable.
+func (cc *ConnectivityChecker) ActualConnectivity() []string {
+	matrix := cc.ActualConnectivityMatrix()
+	_, sourceIdx := cc.uniqueSources()
+	_, targetIdx := cc.uniqueTargets()
+
+	lines := make([]string, len(cc.expected))
+	for i, exp := range cc.expected {
+		res := matrix[sourceIdx[exp.From.SourceName()]][targetIdx[targetKeyFor(exp)]]
+		lines[i] = fmt.Sprintf("%s -> %s = %v", exp.From.SourceName(), exp.Matcher.TargetName, res.Err == nil)
+	}
+	return lines
+}
+
+// ActualConnectivityMatrix probes every recorded expectation and returns the results as
+// a [][]Result keyed by (source, target+protocol) index -- see uniqueSources/uniqueTargets
+// -- rather than the flattened strings ActualConnectivity returns, so callers can assert
+// on the probed topology directly (e.g. "no cross-tier leakage") instead of
+// string-parsing.
+//
+// Probes run concurrently across a bounded worker pool (Workers, default
+// runtime.NumCPU()); probes sharing a source are still safe to run in parallel because
+// the UDP/SCTP ProbeBackend serializes its pre-retry conntrack cleanup per source IP
+// (see conntrackCleanupBackend).
+func (cc *ConnectivityChecker) ActualConnectivityMatrix() [][]Result {
+	sources, sourceIdx := cc.uniqueSources()
+	targets, targetIdx := cc.uniqueTargets()
+
+	matrix := make([][]Result, len(sources))
+	for i := range matrix {
+		matrix[i] = make([]Result, len(targets))
+	}
+
+	type job struct {
+		si, ti int
+		probe  Probe
+	}
+
+	workers := cc.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(cc.expected) {
+		workers = len(cc.expected)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				matrix[j.si][j.ti] = runProbe(j.probe)
+			}
+		}()
+	}
+
+	for _, exp := range cc.expected {
+		jobs <- job{
+			si: sourceIdx[exp.From.SourceName()],
+			ti: targetIdx[targetKeyFor(exp)],
+			probe: Probe{
+				Source:   exp.From,
+				Target:   exp.Matcher,
+				Port:     exp.Matcher.Port,
+				Protocol: exp.Protocol,
+				Options:  exp.Options,
+			},
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return matrix
+}
+
+// runProbe cleans up any stale conntrack state left over from a previous attempt at
+// this exact (source, target) pair, then runs the probe itself.
+func runProbe(p Probe) Result {
+	p.Source.PreRetryCleanup(p.Target.IP, p.Port, p.Protocol, p.Options...)
+	return *p.Source.CanConnectTo(p.Target.IP, p.Port, p.Protocol, p.Options...)
+}
+
+// uniqueSources returns the distinct sources across all recorded expectations, indexed
+// in first-seen order so the matrix layout is deterministic run to run.
+func (cc *ConnectivityChecker) uniqueSources() ([]ConnectionSource, map[string]int) {
+	var sources []ConnectionSource
+	idx := map[string]int{}
+	for _, exp := range cc.expected {
+		name := exp.From.SourceName()
+		if _, ok := idx[name]; !ok {
+			idx[name] = len(sources)
+			sources = append(sources, exp.From)
+		}
+	}
+	return sources, idx
+}
+
+// targetKey identifies one column of the connectivity matrix.  Target name alone isn't
+// enough: two expectations can probe the same source/target pair over different
+// protocols (e.g. "TCP reachable, UDP not" between the same two pods), and those must
+// land in different matrix cells rather than racing to overwrite the same one.
+type targetKey struct {
+	name     string
+	protocol string
+}
+
+// targetKeyFor returns exp's column key for uniqueTargets/ActualConnectivityMatrix.
+func targetKeyFor(exp Expectation) targetKey {
+	return targetKey{name: exp.Matcher.TargetName, protocol: exp.Protocol}
+}
+
+// uniqueTargets returns the distinct (target, protocol) pairs across all recorded
+// expectations, indexed in first-seen order so the matrix layout is deterministic run to
+// run.
+func (cc *ConnectivityChecker) uniqueTargets() ([]*Matcher, map[targetKey]int) {
+	var targets []*Matcher
+	idx := map[targetKey]int{}
+	for _, exp := range cc.expected {
+		key := targetKeyFor(exp)
+		if _, ok := idx[key]; !ok {
+			idx[key] = len(targets)
+			targets = append(targets, exp.Matcher)
+		}
+	}
+	return targets, idx
+}
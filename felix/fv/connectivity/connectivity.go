@@ -0,0 +1,226 @@
+// Copyright (c) 2018-2024 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package connectivity drives the test-connection/test-workload client binary to probe
+// whether one workload can reach another, and collects the result in a form the FV
+// suites can assert on with Gomega matchers.
+package connectivity
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/calico/felix/fv/containers"
+	"github.com/projectcalico/calico/felix/fv/utils"
+)
+
+// Result is the outcome of a single connectivity probe.
+type Result struct {
+	LastHopIP string
+	Protocol  string
+	// Stats is a "PacketLoss[xx]"-style annotation, or "" if there is none.  CheckCtx
+	// does not parse one from the probe's output, so its results always have Stats "".
+	Stats string
+	Err   error
+}
+
+func (r *Result) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("<failed: %v>", r.Err)
+	}
+	if r.Stats != "" {
+		return fmt.Sprintf("<ok from %s, %s>", r.LastHopIP, r.Stats)
+	}
+	return fmt.Sprintf("<ok from %s>", r.LastHopIP)
+}
+
+// Matcher describes a connectivity target for Gomega's HaveConnectivityTo-style
+// matchers: an IP (and/or IPv6 address), port and protocol, plus a human-readable name
+// to use in failure messages.
+type Matcher struct {
+	IP         string
+	IP6        string
+	Port       string
+	TargetName string
+	Protocol   string
+}
+
+func (m *Matcher) String() string {
+	return m.TargetName
+}
+
+type checkOpts struct {
+	sourceIP        string
+	sourcePort      string
+	namespacePath   string
+	sourceInterface string
+	protocolVariant string
+	timeout         time.Duration
+	logSuffix       string
+}
+
+// CheckOption customises a single Check/CheckCtx call.
+type CheckOption func(*checkOpts)
+
+// WithSourceIP binds the probe to the given source IP, e.g. for spoofed or
+// secondary-interface workloads that don't want to use their primary address.
+func WithSourceIP(ip string) CheckOption {
+	return func(o *checkOpts) { o.sourceIP = ip }
+}
+
+// WithSourcePort binds the probe's client socket to a specific source port.
+func WithSourcePort(port string) CheckOption {
+	return func(o *checkOpts) { o.sourcePort = port }
+}
+
+// WithNamespacePath runs the probe inside the given network namespace.
+func WithNamespacePath(path string) CheckOption {
+	return func(o *checkOpts) { o.namespacePath = path }
+}
+
+// WithSourceInterface binds the probe to a named interface via SO_BINDTODEVICE, for
+// workloads with more than one NIC.
+func WithSourceInterface(iface string) CheckOption {
+	return func(o *checkOpts) { o.sourceInterface = iface }
+}
+
+// WithProtocolVariant selects a non-default wire variant of the underlying transport,
+// e.g. "quic" for QUIC/HTTP-3 riding on a UDP transport.
+func WithProtocolVariant(variant string) CheckOption {
+	return func(o *checkOpts) { o.protocolVariant = variant }
+}
+
+// WithTimeout bounds how long the probe waits for a response before it's considered
+// failed.
+func WithTimeout(timeout time.Duration) CheckOption {
+	return func(o *checkOpts) { o.timeout = timeout }
+}
+
+// WithLogSuffix appends suffix to the debug log message a ProbeBackend records for a
+// probe, e.g. "(with source port)" or "(spoofed)", so it's still possible to tell which
+// code path a probe came from despite the backend (not the caller) now owning the log
+// message's base text.
+func WithLogSuffix(suffix string) CheckOption {
+	return func(o *checkOpts) { o.logSuffix = suffix }
+}
+
+// Check runs a single connectivity probe from containerName to ip:port over protocol,
+// logging logMsg alongside the outcome.
+func Check(containerName, logMsg, ip, port, protocol string, opts ...CheckOption) *Result {
+	return CheckCtx(context.Background(), containerName, logMsg, ip, port, protocol, opts...)
+}
+
+// CheckCtx is Check with a caller-supplied context; when ctx carries a deadline shorter
+// than an explicit WithTimeout, the docker exec running the probe is cancelled as soon
+// as ctx is done.
+func CheckCtx(ctx context.Context, containerName, logMsg, ip, port, protocol string, opts ...CheckOption) *Result {
+	o := &checkOpts{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	args := []string{"test-connection", o.namespacePath, ip, port, "--protocol=" + protocol}
+	if o.protocolVariant != "" {
+		args = append(args, "--protocol-variant="+o.protocolVariant)
+	}
+	if o.sourceIP != "" {
+		args = append(args, "--source-ip="+o.sourceIP)
+	}
+	if o.sourcePort != "" {
+		args = append(args, "--source-port="+o.sourcePort)
+	}
+	if o.sourceInterface != "" {
+		args = append(args, "--source-interface="+o.sourceInterface)
+	}
+	if o.timeout != 0 {
+		args = append(args, fmt.Sprintf("--timeout=%.0f", o.timeout.Seconds()))
+	}
+
+	dockerArgs := append([]string{"exec", containerName}, args...)
+	cmd := utils.CommandContext(ctx, "docker", dockerArgs...)
+	out, err := cmd.CombinedOutput()
+	log.WithFields(log.Fields{"out": string(out), "err": err}).Debug(logMsg)
+
+	res := &Result{Protocol: protocol}
+	if err != nil {
+		res.Err = fmt.Errorf("%s: %w: %s", logMsg, err, strings.TrimSpace(string(out)))
+		return res
+	}
+	res.LastHopIP = ip
+	return res
+}
+
+// PersistentConnection drives a long-lived test-connection client, for tests that need
+// to observe a connection surviving (or being killed by) a policy/route change rather
+// than a single point-in-time probe.
+type PersistentConnection struct {
+	RuntimeName   string
+	Runtime       *containers.Container
+	IP            string
+	Port          int
+	Protocol      string
+	NamespacePath string
+	SourcePort    int
+	// SourceInterface, if set, binds the connection to a named interface via
+	// SO_BINDTODEVICE rather than the workload's primary interface.
+	SourceInterface     string
+	MonitorConnectivity bool
+	Timeout             time.Duration
+
+	cmd *exec.Cmd
+}
+
+// Start launches the persistent connection's client process in the background.
+func (pc *PersistentConnection) Start() error {
+	args := []string{
+		"exec", pc.RuntimeName,
+		"test-connection", pc.NamespacePath,
+		pc.IP, fmt.Sprintf("%d", pc.Port),
+		"--protocol=" + pc.Protocol,
+	}
+	if pc.SourcePort != 0 {
+		args = append(args, fmt.Sprintf("--source-port=%d", pc.SourcePort))
+	}
+	if pc.SourceInterface != "" {
+		args = append(args, "--source-interface="+pc.SourceInterface)
+	}
+	if pc.MonitorConnectivity {
+		args = append(args, "--loop-with-file=/tmp/"+pc.RuntimeName+"-status")
+	}
+	if pc.Timeout != 0 {
+		args = append(args, fmt.Sprintf("--timeout=%.0f", pc.Timeout.Seconds()))
+	}
+
+	pc.cmd = utils.Command("docker", args...)
+	if err := pc.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start persistent connection: %w", err)
+	}
+	return nil
+}
+
+// Stop kills the persistent connection's client process.
+func (pc *PersistentConnection) Stop() {
+	if pc.cmd == nil || pc.cmd.Process == nil {
+		return
+	}
+	if err := pc.cmd.Process.Kill(); err != nil {
+		log.WithError(err).Warn("Failed to kill persistent connection")
+	}
+	_, _ = pc.cmd.Process.Wait()
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2018-2024 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package containers wraps the docker containers that host the FV framework's felix and
+// workload instances, giving tests a way to run commands inside them.
+package containers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/calico/felix/fv/utils"
+)
+
+// Container represents a running docker container that a felix instance or workload
+// lives inside.
+type Container struct {
+	Name string
+}
+
+// Exec runs a command inside the container, failing the current Ginkgo spec if it
+// doesn't complete successfully.
+func (c *Container) Exec(args ...string) {
+	err := c.ExecMayFail(args...)
+	Expect(err).NotTo(HaveOccurred(), fmt.Sprintf("Failed to run %v in container %s", args, c.Name))
+}
+
+// ExecMayFail is Exec, but returns the error to the caller instead of failing the spec.
+func (c *Container) ExecMayFail(args ...string) error {
+	_, err := c.ExecCombinedOutput(args...)
+	return err
+}
+
+// ExecContext is Exec with a caller-supplied context; cancelling ctx (or its deadline
+// expiring) kills the underlying "docker exec" rather than leaving it running.
+func (c *Container) ExecContext(ctx context.Context, args ...string) {
+	err := c.ExecMayFailContext(ctx, args...)
+	Expect(err).NotTo(HaveOccurred(), fmt.Sprintf("Failed to run %v in container %s", args, c.Name))
+}
+
+// ExecMayFailContext is ExecMayFail with a caller-supplied context; see ExecContext.
+func (c *Container) ExecMayFailContext(ctx context.Context, args ...string) error {
+	dockerArgs := append([]string{"exec", c.Name}, args...)
+	cmd := utils.CommandContext(ctx, "docker", dockerArgs...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %w: %s", args, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ExecOutput runs a command inside the container and returns its stdout.
+func (c *Container) ExecOutput(args ...string) (string, error) {
+	dockerArgs := append([]string{"exec", c.Name}, args...)
+	cmd := utils.Command("docker", dockerArgs...)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", args, err)
+	}
+	return string(out), nil
+}
+
+// ExecCombinedOutput is ExecOutput, but the returned string includes stderr interleaved
+// with stdout, for commands whose diagnostics matter on failure.
+func (c *Container) ExecCombinedOutput(args ...string) (string, error) {
+	dockerArgs := append([]string{"exec", c.Name}, args...)
+	cmd := utils.Command("docker", dockerArgs...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("%v: %w: %s", args, err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2024 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workload
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/calico/felix/fv/infrastructure"
+	api "github.com/projectcalico/calico/libcalico-go/lib/apis/v3"
+)
+
+// Spec is the New()/Run() argument list bundled up so a topology can be described as a
+// []Spec and started with RunBatch/RunBatchAcross.
+type Spec struct {
+	Name     string
+	Profile  string
+	IP       string
+	Ports    string
+	Protocol string
+	Opts     []Opt
+}
+
+// WorkloadIndexBase pins the next workload's index to base, so that interface names
+// stay reproducible across parallel runs that each need to start their own batch of
+// workloads at a known offset (rather than racing for the next workloadIdx value).
+func WorkloadIndexBase(base int) {
+	// New() increments workloadIdx before using it.
+	workloadIdx = base - 1
+}
+
+// RunBatch creates and starts all the workloads described by specs against a single
+// felix.  The New() bookkeeping (which allocates workloadIdx) is done sequentially, for
+// deterministic interface naming, but the Start() calls run concurrently, which is the
+// dominant cost when a test needs dozens of workloads.  A workload whose Start() fails
+// is retried once, matching the single-shot retry that Run() already does.
+func RunBatch(c *infrastructure.Felix, specs []Spec) []*Workload {
+	wls := make([]*Workload, len(specs))
+	for i, spec := range specs {
+		wls[i] = New(c, spec.Name, spec.Profile, spec.IP, spec.Ports, spec.Protocol, spec.Opts...)
+	}
+	startAllOrRetry(wls)
+	return wls
+}
+
+// RunBatchAcross is RunBatch spread across several felixes, one []Spec per felix.  The
+// per-felix batches are started concurrently with each other as well as internally.
+func RunBatchAcross(felixes []*infrastructure.Felix, specsPerFelix [][]Spec) [][]*Workload {
+	Expect(specsPerFelix).To(HaveLen(len(felixes)), "need one []Spec per felix")
+
+	wlsPerFelix := make([][]*Workload, len(felixes))
+	for i, c := range felixes {
+		wlsPerFelix[i] = make([]*Workload, len(specsPerFelix[i]))
+		for j, spec := range specsPerFelix[i] {
+			wlsPerFelix[i][j] = New(c, spec.Name, spec.Profile, spec.IP, spec.Ports, spec.Protocol, spec.Opts...)
+		}
+	}
+
+	var all []*Workload
+	for _, wls := range wlsPerFelix {
+		all = append(all, wls...)
+	}
+	startAllOrRetry(all)
+
+	return wlsPerFelix
+}
+
+// startAllOrRetry launches Start() for each workload concurrently, then retries (once,
+// concurrently again) any that failed the first time.
+func startAllOrRetry(wls []*Workload) {
+	failed := startAll(wls)
+	if len(failed) == 0 {
+		return
+	}
+	log.WithField("count", len(failed)).Info("Some workloads failed to start, retrying")
+	retryFailed := startAll(failed)
+	Expect(retryFailed).To(BeEmpty(), "workloads failed to start even after a retry")
+}
+
+// startAll runs Start() on every workload concurrently and returns the subset that
+// failed.
+func startAll(wls []*Workload) []*Workload {
+	errs := make([]error, len(wls))
+	var wg sync.WaitGroup
+	wg.Add(len(wls))
+	for i, w := range wls {
+		go func(i int, w *Workload) {
+			defer wg.Done()
+			errs[i] = w.Start()
+		}(i, w)
+	}
+	wg.Wait()
+
+	var failed []*Workload
+	for i, err := range errs {
+		if err != nil {
+			log.WithError(err).WithField("workload", wls[i].Name).Info("Workload failed to start")
+			failed = append(failed, wls[i])
+		}
+	}
+	return failed
+}
+
+// batchDatastoreInfra is implemented by DatastoreInfra backends that can create several
+// WorkloadEndpoints as a single transaction; ConfigureBatchInInfra uses it when present
+// and falls back to one AddWorkload call per workload otherwise.
+type batchDatastoreInfra interface {
+	AddWorkloads([]*api.WorkloadEndpoint) ([]*api.WorkloadEndpoint, error)
+}
+
+// ConfigureBatchInInfra is ConfigureInInfra for a batch of workloads.  When infra
+// supports it, all the primary WorkloadEndpoints are created in a single datastore
+// transaction, with secondary interfaces (if any) published afterwards same as the
+// non-batch path does; otherwise it falls back to configuring each workload in turn.
+func ConfigureBatchInInfra(infra infrastructure.DatastoreInfra, wls []*Workload) {
+	batcher, ok := infra.(batchDatastoreInfra)
+	if !ok {
+		for _, w := range wls {
+			w.ConfigureInInfra(infra)
+		}
+		return
+	}
+
+	weps := make([]*api.WorkloadEndpoint, len(wls))
+	for i, w := range wls {
+		wep := w.WorkloadEndpoint
+		if wep.Namespace == "" {
+			wep.Namespace = "default"
+		}
+		wep.Spec.Workload = w.Name
+		wep.Spec.Endpoint = w.Name
+		wep.Spec.InterfaceName = w.InterfaceName
+		weps[i] = wep
+	}
+
+	created, err := batcher.AddWorkloads(weps)
+	Expect(err).NotTo(HaveOccurred(), "Failed to batch-add workloads")
+	Expect(created).To(HaveLen(len(wls)))
+	for i, w := range wls {
+		w.WorkloadEndpoint = created[i]
+	}
+
+	// Secondary interfaces aren't part of the batch above (AddWorkloads only takes
+	// primary WorkloadEndpoints), but they still need publishing, exactly as the
+	// non-batch ConfigureInInfra fallback does.
+	for _, w := range wls {
+		for _, si := range w.SecondaryInterfaces {
+			w.configureSecondaryInInfra(infra, si)
+		}
+	}
+}
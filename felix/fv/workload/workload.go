@@ -16,11 +16,10 @@ package workload
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
-	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
@@ -66,7 +65,40 @@ type Workload struct {
 	listenAnyIP           bool
 	pid                   string
 
-	cleanupLock sync.Mutex
+	// additionalIfaceSpecs is populated by WithAdditionalInterface and consumed by
+	// Start(), which calls AddSecondaryInterface for each of them once the workload's
+	// primary netns exists.
+	additionalIfaceSpecs []SecondaryInterfaceSpec
+	// SecondaryInterfaces holds one entry per interface attached via
+	// WithAdditionalInterface/AddSecondaryInterface, in the order they were added.
+	SecondaryInterfaces []*SecondaryInterface
+}
+
+// SecondaryInterfaceSpec describes an additional (non-primary) interface to attach to a
+// Workload, for Multus-style multi-NIC FV tests where a pod has its usual Calico veth
+// plus one or more macvlan/ipvlan side NICs.
+type SecondaryInterfaceSpec struct {
+	// IfaceName is the name the interface should have inside the workload's netns.
+	IfaceName string
+	IP4       string
+	IP6       string
+	// Routes are extra "ip route add" argument strings to run, in order, after the
+	// interface is addressed and up, e.g. "10.0.0.0/8 dev <iface>".
+	Routes []string
+	// Profile is the secondary WorkloadEndpoint's profile, mirroring the primary
+	// interface's profile argument to New(); if empty, no WorkloadEndpoint is published
+	// for the interface.  It plays no part in veth naming, which comes from IfaceName.
+	Profile string
+	MTU     int
+}
+
+// SecondaryInterface is the runtime counterpart of a SecondaryInterfaceSpec: the veth
+// pair has been created and, once ConfigureInInfra is called, the WorkloadEndpoint (if
+// any) is populated too.
+type SecondaryInterface struct {
+	Spec             SecondaryInterfaceSpec
+	InterfaceName    string
+	WorkloadEndpoint *api.WorkloadEndpoint
 }
 
 func (w *Workload) GetIP() string {
@@ -165,6 +197,15 @@ func WithHostNetworked() Opt {
 	}
 }
 
+// WithAdditionalInterface requests that a secondary interface matching spec be attached
+// to the workload once it has started, via AddSecondaryInterface.  It can be given more
+// than once to attach several secondary interfaces.
+func WithAdditionalInterface(spec SecondaryInterfaceSpec) Opt {
+	return func(w *Workload) {
+		w.additionalIfaceSpecs = append(w.additionalIfaceSpecs, spec)
+	}
+}
+
 func New(c *infrastructure.Felix, name, profile, ip, ports, protocol string, opts ...Opt) *Workload {
 	workloadIdx++
 	n := fmt.Sprintf("%s-idx%v", name, workloadIdx)
@@ -315,6 +356,12 @@ func (w *Workload) Start() error {
 	w.isRunning = true
 	log.WithField("workload", w).Info("Workload now running")
 
+	for _, spec := range w.additionalIfaceSpecs {
+		if _, err := w.AddSecondaryInterface(spec); err != nil {
+			return fmt.Errorf("failed to add secondary interface %q: %w", spec.IfaceName, err)
+		}
+	}
+
 	return nil
 }
 
@@ -322,37 +369,140 @@ func (w *Workload) IPNet() string {
 	return w.IP + "/32"
 }
 
+// IPNets returns the workload's IP(s) in CIDR form: the IPv4 address as a /32 if set,
+// followed by the IPv6 address as a /128 if set.
+func (w *Workload) IPNets() []string {
+	var nets []string
+	if w.IP != "" {
+		nets = append(nets, w.IP+"/32")
+	}
+	if w.IP6 != "" {
+		nets = append(nets, w.IP6+"/128")
+	}
+	return nets
+}
+
+// AddressFamily selects IPv4 or IPv6 behaviour in the address-family-aware Workload
+// helpers, e.g. AddSpoofInterface and UseSpoofInterface.
+type AddressFamily int
+
+const (
+	AF4 AddressFamily = 4
+	AF6 AddressFamily = 6
+)
+
 // AddSpoofInterface adds a second interface to the workload with name Workload.SpoofIfaceName and moves the
-// workload's IP to its loopback so that we can maintain a TCP connection while moving routes between the two
-// interfaces. From the host's point of view, this looks like one interface is trying to hijack the connection of
-// the other.
-func (w *Workload) AddSpoofInterface() {
+// workload's IP (of the given address family) to its loopback so that we can maintain a connection while moving
+// routes between the two interfaces. From the host's point of view, this looks like one interface is trying to
+// hijack the connection of the other.
+func (w *Workload) AddSpoofInterface(af AddressFamily) {
 	// If the host container, add a new veth pair.
 	w.C.Exec("ip", "link", "add", "name", w.SpoofInterfaceName, "type", "veth", "peer", "name", "spoof0")
 	w.C.Exec("ip", "link", "set", w.SpoofInterfaceName, "addr", "ee:ee:ee:ee:ee:ee")
 	w.C.Exec("ip", "link", "set", "up", w.SpoofInterfaceName)
+	if af == AF6 {
+		// Give the host side of the veth the same link-local address we're about to pin
+		// as the workload's neighbour entry, so fe80::1 is a real next hop rather than
+		// an ARP/NDP entry pointing nowhere.
+		w.C.Exec("ip", "-6", "addr", "add", "fe80::1/64", "dev", w.SpoofInterfaceName)
+	}
 	// Move one end of the veth into the workload netns.
 	w.C.Exec("ip", "link", "set", "spoof0", "netns", w.netns())
 	// In the workload netns, bring up the new interface and then move the IP to the loopback.
 	w.Exec("ip", "link", "set", "up", "spoof0")
-	w.Exec("ip", "addr", "del", w.IP, "dev", "eth0")
-	w.Exec("ip", "addr", "add", w.IP, "dev", "lo")
-	// Recreate the routes, which get removed when we remove the address.
-	w.Exec("ip", "route", "add", "169.254.169.254/32", "dev", "eth0")
-	w.Exec("ip", "route", "add", "default", "via", "169.254.169.254")
-	// Add static ARP entry, otherwise connections fail at the ARP stage because the host won't respond.
-	w.Exec("arp", "-i", "spoof0", "-s", "169.254.169.254", "ee:ee:ee:ee:ee:ee")
+
+	if af == AF6 {
+		w.Exec("ip", "-6", "addr", "del", w.IP6, "dev", "eth0")
+		w.Exec("ip", "-6", "addr", "add", w.IP6, "dev", "lo")
+		// IPv6 has no well-known link-local gateway equivalent to 169.254.169.254, so use
+		// fe80::1 as the pinned next hop instead, mirroring the v4 trick below: the
+		// route's via address and the static neighbour entry must be the same address,
+		// or the default route has no next hop to resolve and routing fails.
+		w.Exec("ip", "-6", "route", "add", "default", "via", "fe80::1", "dev", "spoof0")
+		w.Exec("ip", "-6", "neigh", "add", "fe80::1", "lladdr", "ee:ee:ee:ee:ee:ee", "dev", "spoof0")
+	} else {
+		w.Exec("ip", "addr", "del", w.IP, "dev", "eth0")
+		w.Exec("ip", "addr", "add", w.IP, "dev", "lo")
+		// Recreate the routes, which get removed when we remove the address.
+		w.Exec("ip", "route", "add", "169.254.169.254/32", "dev", "eth0")
+		w.Exec("ip", "route", "add", "default", "via", "169.254.169.254")
+		// Add static ARP entry, otherwise connections fail at the ARP stage because the host won't respond.
+		w.Exec("arp", "-i", "spoof0", "-s", "169.254.169.254", "ee:ee:ee:ee:ee:ee")
+	}
 
 	w.isSpoofing = true
 }
 
-func (w *Workload) UseSpoofInterface(spoof bool) {
+// AddSecondaryInterface attaches an additional veth interface to the workload matching
+// spec, for Multus-style multi-NIC tests.  Unlike AddSpoofInterface, the new interface
+// keeps its own address(es) rather than taking over the primary IP.
+func (w *Workload) AddSecondaryInterface(spec SecondaryInterfaceSpec) (*SecondaryInterface, error) {
+	peerName := fmt.Sprintf("%s-p", spec.IfaceName)
+	if err := w.C.ExecMayFail("ip", "link", "add", "name", spec.IfaceName, "type", "veth", "peer", "name", peerName); err != nil {
+		return nil, fmt.Errorf("failed to create veth pair for secondary interface %q: %w", spec.IfaceName, err)
+	}
+	if err := w.C.ExecMayFail("ip", "link", "set", peerName, "netns", w.netns()); err != nil {
+		return nil, fmt.Errorf("failed to move secondary interface %q into workload netns: %w", spec.IfaceName, err)
+	}
+
+	mtu := spec.MTU
+	if mtu == 0 {
+		mtu = w.MTU
+	}
+	if err := w.ExecMayFail("ip", "link", "set", peerName, "name", spec.IfaceName, "mtu", strconv.Itoa(mtu), "up"); err != nil {
+		return nil, fmt.Errorf("failed to bring up secondary interface %q: %w", spec.IfaceName, err)
+	}
+	if spec.IP4 != "" {
+		if err := w.ExecMayFail("ip", "addr", "add", spec.IP4+"/32", "dev", spec.IfaceName); err != nil {
+			return nil, fmt.Errorf("failed to address secondary interface %q with %s: %w", spec.IfaceName, spec.IP4, err)
+		}
+	}
+	if spec.IP6 != "" {
+		if err := w.ExecMayFail("ip", "-6", "addr", "add", spec.IP6+"/128", "dev", spec.IfaceName); err != nil {
+			return nil, fmt.Errorf("failed to address secondary interface %q with %s: %w", spec.IfaceName, spec.IP6, err)
+		}
+	}
+	for _, route := range spec.Routes {
+		args := append([]string{"route", "add"}, strings.Fields(route)...)
+		if err := w.ExecMayFail("ip", args...); err != nil {
+			return nil, fmt.Errorf("failed to add route %q via secondary interface %q: %w", route, spec.IfaceName, err)
+		}
+	}
+
+	si := &SecondaryInterface{
+		Spec:          spec,
+		InterfaceName: spec.IfaceName,
+	}
+	w.SecondaryInterfaces = append(w.SecondaryInterfaces, si)
+	return si, nil
+}
+
+// SecondaryIPs returns the IPv4 and IPv6 addresses of all the workload's secondary
+// interfaces, in the order they were added.
+func (w *Workload) SecondaryIPs() []string {
+	var ips []string
+	for _, si := range w.SecondaryInterfaces {
+		if si.Spec.IP4 != "" {
+			ips = append(ips, si.Spec.IP4)
+		}
+		if si.Spec.IP6 != "" {
+			ips = append(ips, si.Spec.IP6)
+		}
+	}
+	return ips
+}
+
+func (w *Workload) UseSpoofInterface(af AddressFamily, spoof bool) {
 	var iface string
 	if spoof {
 		iface = "spoof0"
 	} else {
 		iface = "eth0"
 	}
+	if af == AF6 {
+		w.Exec("ip", "-6", "route", "replace", "default", "via", "fe80::1", "dev", iface)
+		return
+	}
 	w.Exec("ip", "route", "replace", "169.254.169.254/32", "dev", iface)
 	w.Exec("ip", "route", "replace", "default", "via", "169.254.169.254", "dev", iface)
 }
@@ -386,6 +536,44 @@ func (w *Workload) ConfigureInInfra(infra infrastructure.DatastoreInfra) {
 	var err error
 	w.WorkloadEndpoint, err = infra.AddWorkload(wep)
 	Expect(err).NotTo(HaveOccurred(), "Failed to add workload")
+
+	for _, si := range w.SecondaryInterfaces {
+		w.configureSecondaryInInfra(infra, si)
+	}
+}
+
+// configureSecondaryInInfra publishes a WorkloadEndpoint for a secondary interface,
+// named after the primary workload with the interface name appended so the two don't
+// collide.  Secondary interfaces with no Profile configured are left unpublished, e.g.
+// for NICs that intentionally sit outside Calico policy (a bare macvlan management NIC).
+func (w *Workload) configureSecondaryInInfra(infra infrastructure.DatastoreInfra, si *SecondaryInterface) {
+	if si.Spec.Profile == "" {
+		return
+	}
+	n := fmt.Sprintf("%s-%s", w.Name, si.Spec.IfaceName)
+	wep := api.NewWorkloadEndpoint()
+	wep.Namespace = "default"
+	wep.Labels = map[string]string{"name": n}
+	wep.Spec.Node = w.WorkloadEndpoint.Spec.Node
+	wep.Spec.Orchestrator = w.WorkloadEndpoint.Spec.Orchestrator
+	wep.Spec.Workload = n
+	wep.Spec.Endpoint = n
+	wep.Spec.InterfaceName = si.InterfaceName
+	wep.Spec.Profiles = []string{si.Spec.Profile}
+	prefixLen := "32"
+	ip := si.Spec.IP4
+	if ip == "" {
+		ip = si.Spec.IP6
+		prefixLen = "128"
+	}
+	wep.Spec.IPNetworks = []string{ip + "/" + prefixLen}
+	if si.Spec.IP4 != "" && si.Spec.IP6 != "" {
+		wep.Spec.IPNetworks = append(wep.Spec.IPNetworks, si.Spec.IP6+"/128")
+	}
+
+	var err error
+	si.WorkloadEndpoint, err = infra.AddWorkload(wep)
+	Expect(err).NotTo(HaveOccurred(), "Failed to add secondary workload endpoint")
 }
 
 // UpdateInInfra updates the workload endpoint for this Workload.
@@ -473,6 +661,16 @@ func (w *Workload) CanConnectTo(ip, port, protocol string, opts ...connectivity.
 	return anyPort.CanConnectTo(ip, port, protocol, opts...)
 }
 
+// CanConnectToCtx is CanConnectTo with a caller-supplied context.  When ctx has a
+// deadline, it's honoured as the probe's total time budget (mapped to the probe
+// binary's -timeout flag) and the underlying docker exec is cancelled via
+// CommandContext, so a ginkgo AfterEach timeout promptly kills the probe rather than
+// leaving it running against a container that's about to be torn down.
+func (w *Workload) CanConnectToCtx(ctx context.Context, ip, port, protocol string, opts ...connectivity.CheckOption) *connectivity.Result {
+	anyPort := w.conncheckAnyPort()
+	return anyPort.CanConnectToCtx(ctx, ip, port, protocol, opts...)
+}
+
 func (w *Workload) conncheckAnyPort() Port {
 	anyPort := Port{
 		Workload: w,
@@ -511,13 +709,23 @@ func (w *Workload) ExecCombinedOutput(args ...string) (string, error) {
 	return w.C.ExecCombinedOutput(args...)
 }
 
+// ExecMayFail runs args inside the workload's netns and returns an error rather than
+// failing the test, unlike Exec.
+func (w *Workload) ExecMayFail(args ...string) error {
+	args = append([]string{"ip", "netns", "exec", w.NamespaceID()}, args...)
+	return w.C.ExecMayFail(args...)
+}
+
 var rttRegexp = regexp.MustCompile(`rtt=(.*) ms`)
 
 func (w *Workload) LatencyTo(ip, port string) (time.Duration, string) {
+	args := []string{"-p", port, "-c", "20", "--fast", "-S", "-n"}
 	if strings.Contains(ip, ":") {
+		args = append(args, "-6")
 		ip = fmt.Sprintf("[%s]", ip)
 	}
-	out, err := w.ExecOutput("hping3", "-p", port, "-c", "20", "--fast", "-S", "-n", ip)
+	args = append(args, ip)
+	out, err := w.ExecOutput(append([]string{"hping3"}, args...)...)
 	stderr := ""
 	var exitErr *exec.ExitError
 	if errors.As(err, &exitErr) {
@@ -554,7 +762,12 @@ func (w *Workload) LatencyTo(ip, port string) (time.Duration, string) {
 func (w *Workload) SendPacketsTo(ip string, count int, size int) (error, string) {
 	c := fmt.Sprintf("%d", count)
 	s := fmt.Sprintf("%d", size)
-	_, err := w.ExecOutput("ping", "-c", c, "-W", "1", "-s", s, ip)
+	cmd := "ping"
+	args := []string{"-c", c, "-W", "1", "-s", s, ip}
+	if strings.Contains(ip, ":") {
+		args = append([]string{"-6"}, args...)
+	}
+	_, err := w.ExecOutput(append([]string{cmd}, args...)...)
 	stderr := ""
 	var exitErr *exec.ExitError
 	if errors.As(err, &exitErr) {
@@ -649,6 +862,9 @@ type PersistentConnectionOpts struct {
 	SourcePort          int
 	MonitorConnectivity bool
 	Timeout             time.Duration
+	// SourceInterface, if set, binds the connection to one of the workload's
+	// SecondaryInterfaces via SO_BINDTODEVICE, rather than the primary interface.
+	SourceInterface string
 }
 
 func (w *Workload) StartPersistentConnectionMayFail(
@@ -665,6 +881,7 @@ func (w *Workload) StartPersistentConnectionMayFail(
 		SourcePort:          opts.SourcePort,
 		MonitorConnectivity: opts.MonitorConnectivity,
 		Timeout:             opts.Timeout,
+		SourceInterface:     opts.SourceInterface,
 	}
 
 	err := pc.Start()
@@ -702,6 +919,15 @@ func (w *Workload) ToMatcher(explicitPort ...uint16) *connectivity.Matcher {
 	}
 }
 
+// ToMatcherV6 is like ToMatcher but matches on the workload's IPv6 address, for tests
+// that want to assert connectivity to a dual-stack workload's v6 side specifically.
+func (w *Workload) ToMatcherV6(explicitPort ...uint16) *connectivity.Matcher {
+	m := w.ToMatcher(explicitPort...)
+	m.IP = w.IP6
+	m.IP6 = ""
+	return m
+}
+
 const nsprefix = "/var/run/netns/"
 
 func (w *Workload) netns() string {
@@ -727,14 +953,20 @@ func (w *Workload) RunCmd(cmd string, args ...string) (string, error) {
 	return string(out), err
 }
 
+// PathMTU returns the cached path MTU to ip, which may be an IPv4 literal or a
+// (optionally bracketed) IPv6 literal.
 func (w *Workload) PathMTU(ip string) (int, error) {
 	out, err := w.RunCmd("ip", "route", "show", "cached")
 	if err != nil {
 		return 0, err
 	}
 
+	// "ip route show cached" never brackets IPv6 literals, so strip the brackets (if
+	// any) before matching against its output.
+	ip = strings.TrimPrefix(strings.TrimSuffix(ip, "]"), "[")
+
 	outRd := bufio.NewReader(strings.NewReader(out))
-	ipRegex := regexp.MustCompile("^" + ip + ".*")
+	ipRegex := regexp.MustCompile("^" + regexp.QuoteMeta(ip) + ".*")
 	mtuRegex := regexp.MustCompile(".*mtu ([0-9]+)")
 	for {
 		line, err := outRd.ReadString('\n')
@@ -755,11 +987,17 @@ func (w *Workload) PathMTU(ip string) (int, error) {
 	}
 }
 
-// AttachTCPDump returns tcpdump attached to the workload
+// AttachTCPDump returns tcpdump attached to the workload's primary interface.
 func (w *Workload) AttachTCPDump() *tcpdump.TCPDump {
+	return w.AttachTCPDumpOn("eth0")
+}
+
+// AttachTCPDumpOn returns tcpdump attached to the named interface inside the workload's
+// netns, e.g. one of its SecondaryInterfaces.
+func (w *Workload) AttachTCPDumpOn(iface string) *tcpdump.TCPDump {
 	netns := w.netns()
-	tcpd := tcpdump.Attach(w.C.Name, netns, "eth0")
-	tcpd.SetLogString(w.Name)
+	tcpd := tcpdump.Attach(w.C.Name, netns, iface)
+	tcpd.SetLogString(fmt.Sprintf("%s[%s]", w.Name, iface))
 	return tcpd
 }
 
@@ -783,6 +1021,34 @@ func (s *SpoofedWorkload) appendSourceIPOpt(opts []connectivity.CheckOption) []c
 	return opts
 }
 
+// OnInterface returns a view of the workload whose connectivity checks originate from
+// the named secondary interface (via SO_BINDTODEVICE in the probe binary), rather than
+// the primary interface.
+func (w *Workload) OnInterface(iface string) *InterfaceBoundWorkload {
+	return &InterfaceBoundWorkload{Workload: w, SourceInterface: iface}
+}
+
+// InterfaceBoundWorkload binds connectivity checks to one of the workload's
+// SecondaryInterfaces, for Multus-style multi-NIC tests.
+type InterfaceBoundWorkload struct {
+	*Workload
+	SourceInterface string
+}
+
+func (i *InterfaceBoundWorkload) PreRetryCleanup(ip, port, protocol string, opts ...connectivity.CheckOption) {
+	opts = i.appendSourceInterfaceOpt(opts)
+	i.Workload.preRetryCleanupInner(ip, port, protocol, "(on "+i.SourceInterface+")", opts...)
+}
+
+func (i *InterfaceBoundWorkload) CanConnectTo(ip, port, protocol string, opts ...connectivity.CheckOption) *connectivity.Result {
+	opts = i.appendSourceInterfaceOpt(opts)
+	return i.Workload.canConnectToInner(ip, port, protocol, "(on "+i.SourceInterface+")", opts...)
+}
+
+func (i *InterfaceBoundWorkload) appendSourceInterfaceOpt(opts []connectivity.CheckOption) []connectivity.CheckOption {
+	return append(opts, connectivity.WithSourceInterface(i.SourceInterface))
+}
+
 type Port struct {
 	*Workload
 	Port uint16
@@ -801,14 +1067,21 @@ func (p *Port) SourceIPs() []string {
 
 func (p *Port) PreRetryCleanup(ip, port, protocol string, opts ...connectivity.CheckOption) {
 	opts = p.maybeAppendPortOpt(opts)
-	p.Workload.preRetryCleanupInner(ip, port, protocol, "(with source port)", opts...)
+	p.Workload.preRetryCleanupInnerCtx(context.Background(), ip, port, protocol, "(with source port)", opts...)
 }
 
 // Return if a connection is good and packet loss string "PacketLoss[xx]".
 // If it is not a packet loss test, packet loss string is "".
 func (p *Port) CanConnectTo(ip, port, protocol string, opts ...connectivity.CheckOption) *connectivity.Result {
 	opts = p.maybeAppendPortOpt(opts)
-	return p.Workload.canConnectToInner(ip, port, protocol, "(with source port)", opts...)
+	return p.Workload.canConnectToInnerCtx(context.Background(), ip, port, protocol, "(with source port)", opts...)
+}
+
+// CanConnectToCtx is CanConnectTo with a caller-supplied context; see
+// Workload.CanConnectToCtx.
+func (p *Port) CanConnectToCtx(ctx context.Context, ip, port, protocol string, opts ...connectivity.CheckOption) *connectivity.Result {
+	opts = p.maybeAppendPortOpt(opts)
+	return p.Workload.canConnectToInnerCtx(ctx, ip, port, protocol, "(with source port)", opts...)
 }
 
 func (p *Port) maybeAppendPortOpt(opts []connectivity.CheckOption) []connectivity.CheckOption {
@@ -818,33 +1091,72 @@ func (p *Port) maybeAppendPortOpt(opts []connectivity.CheckOption) []connectivit
 	return opts
 }
 
+// transportProtocol maps a user-facing protocol name to the underlying transport
+// protocol that actually goes on the wire, plus a "variant" hint for protocols that
+// layer over a different transport's socket.  QUIC/HTTP-3 run over UDP, so both names
+// resolve to transport "udp" with variant "quic".
+func transportProtocol(protocol string) (transport, variant string) {
+	switch protocol {
+	case "quic", "http3":
+		return "udp", "quic"
+	default:
+		return protocol, ""
+	}
+}
+
 func (w *Workload) preRetryCleanupInner(ip, port, protocol, logSuffix string, opts ...connectivity.CheckOption) {
-	if protocol == "udp" || protocol == "sctp" {
-		// Defensive, we might get called in parallel for different ports, avoid trying to run
-		// clashing cleanup commands at the same time.
-		w.cleanupLock.Lock()
-		defer w.cleanupLock.Unlock()
-
-		// If this is a retry then we may have stale conntrack entries and we don't want those
-		// to influence the connectivity check.  UDP lacks a sequence number, so conntrack operates
-		// on a simple timer. In the case of SCTP, conntrack appears to match packets even when
-		// the conntrack entry is in the CLOSED state.
-		if os.Getenv("FELIX_FV_ENABLE_BPF") == "true" {
-			w.C.Exec("calico-bpf", "conntrack", "remove", "udp", w.IP, ip)
-		} else {
-			_ = w.C.ExecMayFail("conntrack", "-D", "-p", protocol, "-s", w.IP, "-d", ip)
-		}
+	w.preRetryCleanupInnerCtx(context.Background(), ip, port, protocol, logSuffix, opts...)
+}
+
+// preRetryCleanupInnerCtx used to hard-code which protocols need a conntrack flush
+// between retries (and serialize them all through one Workload-wide cleanupLock); both
+// of those decisions now belong to the registered connectivity.ProbeBackend for the
+// transport, so a protocol that doesn't need cleanup (TCP) never waits on one that does.
+func (w *Workload) preRetryCleanupInnerCtx(ctx context.Context, ip, port, protocol, logSuffix string, opts ...connectivity.CheckOption) {
+	transport, _ := transportProtocol(protocol)
+	backend, ok := connectivity.Backend(transport)
+	if !ok {
+		return
+	}
+	src := connectivity.SocketTuple{ContainerName: w.C.Name, IP: w.IP}
+	dst := connectivity.SocketTuple{IP: ip}
+	if err := backend.PreRetryCleanup(ctx, src, dst); err != nil {
+		log.WithError(err).WithField("workload", w.Name).Debug("Pre-retry cleanup failed (best-effort, ignored)")
 	}
 }
 
 func (w *Workload) canConnectToInner(ip, port, protocol, logSuffix string, opts ...connectivity.CheckOption) *connectivity.Result {
-	logMsg := "Connection test"
+	return w.canConnectToInnerCtx(context.Background(), ip, port, protocol, logSuffix, opts...)
+}
 
+// canConnectToInnerCtx is canConnectToInner with a caller-supplied context; ctx's
+// deadline (if any) becomes the probe's -timeout budget and cancels the docker exec
+// that runs it.  The actual wire protocol is delegated to the connectivity.ProbeBackend
+// registered for it, so adding a new protocol no longer means patching this method.
+func (w *Workload) canConnectToInnerCtx(ctx context.Context, ip, port, protocol, logSuffix string, opts ...connectivity.CheckOption) *connectivity.Result {
 	// enforce the name space as we want to execute it in the workload
-	opts = append(opts, connectivity.WithNamespacePath(w.namespacePath))
-	logMsg += " " + logSuffix
+	opts = append(opts, connectivity.WithNamespacePath(w.namespacePath), connectivity.WithLogSuffix(logSuffix))
+
+	transport, variant := transportProtocol(protocol)
+	if variant != "" {
+		opts = append(opts, connectivity.WithProtocolVariant(variant))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append(opts, connectivity.WithTimeout(time.Until(deadline)))
+	}
 
-	return connectivity.Check(w.C.Name, logMsg, ip, port, protocol, opts...)
+	backend, ok := connectivity.Backend(transport)
+	if !ok {
+		return &connectivity.Result{Err: fmt.Errorf("no connectivity.ProbeBackend registered for protocol %q", transport)}
+	}
+
+	src := connectivity.SocketTuple{ContainerName: w.C.Name, IP: w.IP}
+	dst := connectivity.SocketTuple{IP: ip, Port: port}
+	res, err := backend.Probe(ctx, src, dst, opts...)
+	if res == nil {
+		res = &connectivity.Result{Err: err}
+	}
+	return res
 }
 
 // ToMatcher implements the connectionTarget interface, allowing this port to be used as
@@ -861,7 +1173,23 @@ func (p *Port) ToMatcher(explicitPort ...uint16) *connectivity.Matcher {
 	}
 }
 
+// ToMatcherForProtocol is like ToMatcher, but annotates the target name with protocol
+// when it's one that isn't self-evident from "on port N" alone (e.g. QUIC/HTTP-3 over
+// what's otherwise indistinguishable from a plain UDP target), so a failure message
+// reads "QUIC <name> on port <n>" rather than requiring the reader to cross-reference
+// the test's protocol argument.
+func (p *Port) ToMatcherForProtocol(protocol string, explicitPort ...uint16) *connectivity.Matcher {
+	m := p.ToMatcher(explicitPort...)
+	if _, variant := transportProtocol(protocol); variant == "quic" {
+		m.TargetName = fmt.Sprintf("QUIC %s", m.TargetName)
+	}
+	return m
+}
+
 func (w *Workload) InterfaceIndex() int {
+	if err := w.WaitForInterface(w.InterfaceName, InterfaceStateExists, 5*time.Second); err != nil {
+		ginkgo.Fail(fmt.Sprintf("Interface %s never appeared: %v", w.InterfaceName, err))
+	}
 	out, err := w.C.ExecOutput("ip", "link", "show", "dev", w.InterfaceName)
 	Expect(err).NotTo(HaveOccurred())
 	ifIndex, err := strconv.Atoi(strings.SplitN(out, ":", 2)[0])
@@ -870,35 +1198,219 @@ func (w *Workload) InterfaceIndex() int {
 	return ifIndex
 }
 
+// RenameInterface renames the host-side interface from to to.  "ip link set ... name
+// ..." itself can fail with EBUSY while the kernel is still finishing bringing up a
+// freshly-created veth, so the rename is retried until it succeeds or renameTimeout
+// elapses; between attempts it waits for the next link event on the interface (rather
+// than polling "ip link show", which already reports the interface as existing and so
+// would just busy-loop against the same EBUSY) so each retry is driven by the kernel
+// actually making progress, not a jittered sleep.
 func (w *Workload) RenameInterface(from, to string) {
+	if err := w.WaitForInterface(from, InterfaceStateExists, 5*time.Second); err != nil {
+		ginkgo.Fail(fmt.Sprintf("Interface %s never appeared to be renamed to %s: %v", from, to, err))
+	}
+
+	const renameTimeout = 20 * time.Second
+	deadline := time.Now().Add(renameTimeout)
 	var err error
-	sleep := 100 * time.Millisecond
-	for try := 0; try < 40; try++ {
-		// Can fail with EBUSY.
+	for {
 		err = w.C.ExecMayFail("ip", "link", "set", from, "name", to)
 		if err == nil {
 			return
 		}
-		time.Sleep(sleep)
-		sleep = time.Duration(float64(sleep) * (1.5 + rand.Float64()))
-		const maxSleep = 2 * time.Second
-		if sleep > maxSleep {
-			sleep = maxSleep
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		if waitErr := w.waitForNextLinkEvent(from, remaining); waitErr != nil {
+			break
 		}
 	}
-	ginkgo.Fail(fmt.Sprintf("Failed to rename interface %s to %s after several retries: %s", from, to, err))
+	ginkgo.Fail(fmt.Sprintf("Failed to rename interface %s to %s: %v", from, to, err))
 }
 
 func (w *Workload) SetInterfaceUp(b bool) {
+	wantState := InterfaceStateDown
 	if b {
 		w.C.Exec("ip", "link", "set", "up", w.InterfaceName)
+		wantState = InterfaceStateUp
 	} else {
 		w.C.Exec("ip", "link", "set", "down", w.InterfaceName)
 	}
+	if err := w.WaitForInterface(w.InterfaceName, wantState, 5*time.Second); err != nil {
+		ginkgo.Fail(fmt.Sprintf("Interface %s never reached state %s: %v", w.InterfaceName, wantState, err))
+	}
+}
+
+// InterfaceState is a condition WaitForInterface can wait for on a host-side interface.
+type InterfaceState int
+
+const (
+	InterfaceStateExists InterfaceState = iota
+	InterfaceStateGone
+	InterfaceStateUp
+	InterfaceStateDown
+)
+
+func (s InterfaceState) String() string {
+	switch s {
+	case InterfaceStateExists:
+		return "exists"
+	case InterfaceStateGone:
+		return "gone"
+	case InterfaceStateUp:
+		return "up"
+	case InterfaceStateDown:
+		return "down"
+	}
+	return "unknown"
+}
+
+// interfaceLinkRegexp matches both the NEWLINK/CHGLINK and DELLINK forms of a single
+// line of "ip monitor link" output, e.g.:
+//
+//	34: cali1234@if35: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 ...
+//	Deleted 34: cali1234@if35: <BROADCAST,MULTICAST> mtu 1500 ...
+func interfaceLinkRegexp(name string) *regexp.Regexp {
+	return regexp.MustCompile(`^(Deleted\s+)?\d+:\s+` + regexp.QuoteMeta(name) + `(@\S+)?:\s*<([^>]*)>`)
+}
+
+func hasFlag(flags []string, want string) bool {
+	for _, f := range flags {
+		if f == want {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceState reports whether name currently exists on the host side and, if so,
+// whether it's admin-up, by inspecting "ip link show dev" once.
+func (w *Workload) interfaceState(name string) (exists bool, up bool) {
+	out, err := w.C.ExecOutput("ip", "link", "show", "dev", name)
+	if err != nil {
+		return false, false
+	}
+	m := interfaceLinkRegexp(name).FindStringSubmatch(strings.TrimSpace(out))
+	if m == nil {
+		return true, false
+	}
+	return true, hasFlag(strings.Split(m[3], ","), "UP")
+}
+
+func interfaceSatisfiesState(exists, up bool, state InterfaceState) bool {
+	switch state {
+	case InterfaceStateExists:
+		return exists
+	case InterfaceStateGone:
+		return !exists
+	case InterfaceStateUp:
+		return exists && up
+	case InterfaceStateDown:
+		return exists && !up
+	}
+	return false
+}
+
+// WaitForInterface blocks until the named host-side interface satisfies state, or
+// returns an error once timeout elapses.  Rather than polling "ip link show" with a
+// jittered-backoff sleep -- retrying on a racy syscall is really a symptom of missing
+// readiness notification -- it subscribes to the kernel's RTMGRP_LINK netlink event
+// stream (via "ip monitor link") and returns as soon as a NEWLINK/DELLINK/CHGLINK event
+// matching the predicate arrives, giving deterministic, event-driven synchronization.
+func (w *Workload) WaitForInterface(name string, state InterfaceState, timeout time.Duration) error {
+	if exists, up := w.interfaceState(name); interfaceSatisfiesState(exists, up, state) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := utils.CommandContext(ctx, "docker", "exec", w.C.Name, "ip", "monitor", "link")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open \"ip monitor link\" stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start \"ip monitor link\": %w", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_, _ = cmd.Wait()
+	}()
+
+	// The interface may have reached state between our check above and the monitor
+	// coming up; re-check now there's no longer a window for us to miss the event.
+	if exists, up := w.interfaceState(name); interfaceSatisfiesState(exists, up, state) {
+		return nil
+	}
+
+	re := interfaceLinkRegexp(name)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		m := re.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		deleted := m[1] != ""
+		up := hasFlag(strings.Split(m[3], ","), "UP")
+		if interfaceSatisfiesState(!deleted, up, state) {
+			return nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s waiting for interface %s to reach state %s", timeout, name, state)
+	}
+	return fmt.Errorf("\"ip monitor link\" ended before interface %s reached state %s", name, state)
+}
+
+// waitForNextLinkEvent blocks until the next NEWLINK/CHGLINK/DELLINK event for name
+// arrives on the netlink event stream, or returns an error once timeout elapses.
+// Unlike WaitForInterface, it never short-circuits on the interface's current state --
+// it's for callers that need to wait out a transient condition (e.g. the kernel still
+// finishing bring-up of a freshly-created veth) that a plain state check can't observe
+// because the interface already "exists" throughout.
+func (w *Workload) waitForNextLinkEvent(name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := utils.CommandContext(ctx, "docker", "exec", w.C.Name, "ip", "monitor", "link")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open \"ip monitor link\" stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start \"ip monitor link\": %w", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_, _ = cmd.Wait()
+	}()
+
+	re := interfaceLinkRegexp(name)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if re.MatchString(scanner.Text()) {
+			return nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s waiting for a link event on interface %s", timeout, name)
+	}
+	return fmt.Errorf("\"ip monitor link\" ended before a link event on interface %s arrived", name)
 }
 
 func (w *Workload) ExecCommand(name string, args ...string) *exec.Cmd {
+	return w.ExecCommandContext(context.Background(), name, args...)
+}
+
+// ExecCommandContext is ExecCommand with a caller-supplied context: the returned
+// *exec.Cmd is built with exec.CommandContext, so cancelling ctx (or its deadline
+// expiring) SIGKILLs the "docker exec" promptly instead of leaking it.
+func (w *Workload) ExecCommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
 	args = append([]string{"exec", w.C.Name, "ip", "netns", "exec", w.NamespaceID(), name}, args...)
-	cmd := utils.Command("docker", args...)
+	cmd := utils.CommandContext(ctx, "docker", args...)
 	return cmd
 }